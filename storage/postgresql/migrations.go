@@ -0,0 +1,134 @@
+package postgresql
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// schemaMigrationsLockKey is an arbitrary, fixed advisory lock key so that
+// concurrent relay instances starting up at once serialize on running
+// migrations instead of racing to apply the same version twice.
+const schemaMigrationsLockKey = 72146_0001
+
+type migration struct {
+	version int64
+	name    string
+	up      string
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationsFS.ReadDir("migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embedded migrations: %w", err)
+	}
+
+	migrations := make([]migration, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+
+		version, name, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration file %q does not match version_name.sql", entry.Name())
+		}
+		v, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration file %q has a non-numeric version: %w", entry.Name(), err)
+		}
+
+		contents, err := migrationsFS.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %q: %w", entry.Name(), err)
+		}
+
+		up, _, _ := strings.Cut(string(contents), "-- +goose Down")
+		up = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(up), "-- +goose Up"))
+
+		migrations = append(migrations, migration{version: v, name: name, up: up})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// Migrate brings the schema up to date with the embedded migrations/*.sql
+// files, tracking applied versions in schema_migrations. It takes a
+// postgres advisory lock for the duration of the run so that multiple
+// relay instances starting up concurrently don't apply the same migration
+// twice.
+func (b *PostgresBackend) Migrate(ctx context.Context) error {
+	if _, err := b.DB.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version BIGINT PRIMARY KEY,
+  applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+	`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	conn, err := b.DB.Connx(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire a connection to run migrations: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", schemaMigrationsLockKey); err != nil {
+		return fmt.Errorf("failed to acquire migration advisory lock: %w", err)
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", schemaMigrationsLockKey)
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	applied := make(map[int64]bool, len(migrations))
+	rows, err := conn.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return fmt.Errorf("failed to read applied migrations: %w", err)
+	}
+	for rows.Next() {
+		var version int64
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan applied migration version: %w", err)
+		}
+		applied[version] = true
+	}
+	rows.Close()
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+
+		txn, err := b.DB.BeginTxx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction for migration %d_%s: %w", m.version, m.name, err)
+		}
+
+		if _, err := txn.ExecContext(ctx, m.up); err != nil {
+			txn.Rollback()
+			return fmt.Errorf("failed to apply migration %d_%s: %w", m.version, m.name, err)
+		}
+		if _, err := txn.ExecContext(ctx,
+			"INSERT INTO schema_migrations (version) VALUES ($1)", m.version); err != nil {
+			txn.Rollback()
+			return fmt.Errorf("failed to record migration %d_%s: %w", m.version, m.name, err)
+		}
+
+		if err := txn.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d_%s: %w", m.version, m.name, err)
+		}
+	}
+
+	return nil
+}
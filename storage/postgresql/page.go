@@ -0,0 +1,127 @@
+package postgresql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// MarkBegin is the cursor that starts a fresh page from the newest event.
+	MarkBegin = ""
+	// MarkEnd is returned as the next cursor once a page comes back with
+	// fewer than LIMIT rows, telling the caller there is nothing more to page.
+	MarkEnd = "end"
+)
+
+// pageCursor is the decoded form of an opaque keyset cursor: the
+// (created_at, id) of the last row a previous page ended on.
+type pageCursor struct {
+	createdAt int64
+	id        string
+}
+
+func encodeCursor(createdAt nostr.Timestamp, id string) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", createdAt, id)))
+}
+
+func decodeCursor(cursor string) (*pageCursor, error) {
+	if cursor == MarkBegin {
+		return nil, nil
+	}
+	if cursor == MarkEnd {
+		return nil, fmt.Errorf("cursor %q marks the end of pagination and cannot be paged from", cursor)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %q: %w", cursor, err)
+	}
+
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid cursor %q", cursor)
+	}
+
+	createdAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %q: %w", cursor, err)
+	}
+
+	return &pageCursor{createdAt: createdAt, id: parts[1]}, nil
+}
+
+// QueryEventsPaged is the keyset-paginated counterpart to QueryEvents. A
+// client pages forward by feeding the returned next cursor back in; an
+// empty cursor (MarkBegin) starts from the newest event and MarkEnd means
+// there is nothing left to fetch. A filter with Search set may only be
+// used for a single, cursor-less page (the first one) since search results
+// are sorted by relevance rather than created_at.
+func (b PostgresBackend) QueryEventsPaged(ctx context.Context, filter *nostr.Filter, cursor string) (ch chan *nostr.Event, next string, err error) {
+	if filter != nil && filter.Search != "" && cursor != MarkBegin {
+		// a search page is ordered by ts_rank_cd, not created_at, so the
+		// keyset boundary built from the previous page's last row would
+		// cut off by the wrong sort order and silently drop matching
+		// events from later pages
+		return nil, "", fmt.Errorf("cannot paginate a Search filter with a cursor: " +
+			"search results are ranked by relevance, not created_at, so keyset pagination doesn't apply")
+	}
+
+	pc, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	shape, query, params, err := b.queryEventsSql(filter, false, pc)
+	if err != nil {
+		return nil, "", err
+	}
+
+	stmt, err := b.stmtCache.getOrPrepare(b.DB, shape, query)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to prepare query %q: %w", query, err)
+	}
+
+	rows, err := stmt.QueryContext(ctx, params...)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, "", fmt.Errorf("failed to fetch events using query %q: %w", query, err)
+	}
+	defer rows.Close()
+
+	limit := b.QueryLimit
+	if filter.Limit >= 1 && filter.Limit <= b.QueryLimit {
+		limit = filter.Limit
+	}
+
+	events := make([]*nostr.Event, 0, limit)
+	for rows.Next() {
+		var evt nostr.Event
+		var timestamp int64
+		if err := rows.Scan(&evt.ID, &evt.PubKey, &timestamp,
+			&evt.Kind, &evt.Tags, &evt.Content, &evt.Sig); err != nil {
+			return nil, "", fmt.Errorf("failed to scan event: %w", err)
+		}
+		evt.CreatedAt = nostr.Timestamp(timestamp)
+		events = append(events, &evt)
+	}
+
+	if len(events) < limit {
+		next = MarkEnd
+	} else {
+		last := events[len(events)-1]
+		next = encodeCursor(last.CreatedAt, last.ID)
+	}
+
+	ch = make(chan *nostr.Event, len(events))
+	for _, evt := range events {
+		ch <- evt
+	}
+	close(ch)
+
+	return ch, next, nil
+}
@@ -0,0 +1,150 @@
+package postgresql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+type PostgresBackend struct {
+	*sqlx.DB
+	DatabaseURL       string
+	QueryLimit        int
+	QueryIDsLimit     int
+	QueryAuthorsLimit int
+	QueryKindsLimit   int
+	QueryTagsLimit    int
+
+	// SearchLanguage is the text search configuration (dictionary) used for
+	// NIP-50 search. It is passed to both to_tsvector and plainto_tsquery at
+	// query time (see queryEventsSql), so content is re-tokenized with the
+	// configured dictionary on every search rather than relying on a
+	// generated column baked with a fixed one. Defaults to "simple".
+	SearchLanguage string
+
+	// MaxPreparedStatements bounds how many distinct filter shapes are kept
+	// prepared against DB at once; least-recently-used shapes are evicted
+	// and their server-side statements closed.
+	MaxPreparedStatements int
+
+	// AutoMigrate, when true, makes Init run Migrate automatically so the
+	// schema is brought up to date with the embedded migrations/*.sql
+	// files on startup. Operators who prefer to run goose themselves as a
+	// separate deploy step should leave this false.
+	AutoMigrate bool
+
+	stmtCache *stmtCache
+}
+
+func (b *PostgresBackend) Init() error {
+	db, err := sqlx.Connect("postgres", b.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(80)
+	b.DB = db
+
+	if b.AutoMigrate {
+		if err := b.Migrate(context.Background()); err != nil {
+			return fmt.Errorf("failed to run migrations: %w", err)
+		}
+	}
+
+	if b.QueryLimit == 0 {
+		b.QueryLimit = 100
+	}
+	if b.QueryIDsLimit == 0 {
+		b.QueryIDsLimit = 500
+	}
+	if b.QueryAuthorsLimit == 0 {
+		b.QueryAuthorsLimit = 500
+	}
+	if b.QueryKindsLimit == 0 {
+		b.QueryKindsLimit = 10
+	}
+	if b.QueryTagsLimit == 0 {
+		b.QueryTagsLimit = 10
+	}
+	if b.SearchLanguage == "" {
+		b.SearchLanguage = "simple"
+	}
+	if b.MaxPreparedStatements == 0 {
+		b.MaxPreparedStatements = 200
+	}
+	b.stmtCache = newStmtCache(b.MaxPreparedStatements)
+
+	return nil
+}
+
+func (b PostgresBackend) SaveEvent(evt *nostr.Event) error {
+	tagsj, err := json.Marshal(evt.Tags)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tags for event %s: %w", evt.ID, err)
+	}
+
+	txn, err := b.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for event %s: %w", evt.ID, err)
+	}
+	defer txn.Rollback()
+
+	// tagvalues is kept populated during the transition to the normalized
+	// event_tag table below so deployments can migrate without downtime.
+	res, err := txn.Exec(`
+INSERT INTO event (id, pubkey, created_at, kind, tags, content, sig, tagvalues)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (id) DO NOTHING
+	`, evt.ID, evt.PubKey, evt.CreatedAt, evt.Kind, tagsj, evt.Content, evt.Sig, tagValuesArray(evt.Tags))
+	if err != nil {
+		return fmt.Errorf("failed to save event %s: %w", evt.ID, err)
+	}
+
+	// the event already existed, so event_tag was populated the first time
+	// it was saved; inserting again here would duplicate every row
+	if inserted, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to check rows affected for event %s: %w", evt.ID, err)
+	} else if inserted == 0 {
+		return txn.Commit()
+	}
+
+	for position, tag := range evt.Tags {
+		if len(tag) < 2 || len(tag[0]) == 0 {
+			continue
+		}
+		if _, err := txn.Exec(`
+INSERT INTO event_tag (event_id, tag_name, tag_value, position)
+VALUES ($1, $2, $3, $4)
+		`, evt.ID, tag[0], tag[1], position); err != nil {
+			return fmt.Errorf("failed to save tag %d for event %s: %w", position, evt.ID, err)
+		}
+	}
+
+	if err := txn.Commit(); err != nil {
+		return fmt.Errorf("failed to commit event %s: %w", evt.ID, err)
+	}
+
+	return nil
+}
+
+func (b PostgresBackend) DeleteEvent(id string, pubkey string) error {
+	_, err := b.DB.Exec(`DELETE FROM event WHERE id = $1 AND pubkey = $2`, id, pubkey)
+	if err != nil {
+		return fmt.Errorf("failed to delete event %s: %w", id, err)
+	}
+	return nil
+}
+
+func tagValuesArray(tags nostr.Tags) []string {
+	values := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if len(tag) < 2 {
+			continue
+		}
+		values = append(values, tag[1])
+	}
+	return values
+}
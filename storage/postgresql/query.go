@@ -5,23 +5,33 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"fmt"
-	"strconv"
 	"strings"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/nbd-wtf/go-nostr"
 )
 
 func (b PostgresBackend) QueryEvents(ctx context.Context, filter *nostr.Filter) (ch chan *nostr.Event, err error) {
 	ch = make(chan *nostr.Event)
 
-	query, params, err := b.queryEventsSql(filter, false)
+	// QueryEvents runs the same query as the first, cursor-less page of
+	// QueryEventsPaged and streams the rows over ch as they are scanned,
+	// without returning a next cursor; callers that need stable pagination
+	// should call QueryEventsPaged directly.
+	shape, query, params, err := b.queryEventsSql(filter, false, nil)
 	if err != nil {
 		close(ch)
 		return nil, err
 	}
 
-	rows, err := b.DB.Query(query, params...)
+	stmt, err := b.stmtCache.getOrPrepare(b.DB, shape, query)
+	if err != nil {
+		close(ch)
+		return nil, fmt.Errorf("failed to prepare query %q: %w", query, err)
+	}
+
+	rows, err := stmt.QueryContext(ctx, params...)
 	if err != nil && err != sql.ErrNoRows {
 		close(ch)
 		return nil, fmt.Errorf("failed to fetch events using query %q: %w", query, err)
@@ -39,7 +49,14 @@ func (b PostgresBackend) QueryEvents(ctx context.Context, filter *nostr.Filter)
 				return
 			}
 			evt.CreatedAt = nostr.Timestamp(timestamp)
-			ch <- &evt
+
+			// a disconnected subscriber must not stall this goroutine
+			// forever on a blocking, unbuffered channel send
+			select {
+			case ch <- &evt:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
@@ -47,126 +64,165 @@ func (b PostgresBackend) QueryEvents(ctx context.Context, filter *nostr.Filter)
 }
 
 func (b PostgresBackend) CountEvents(ctx context.Context, filter *nostr.Filter) (int64, error) {
-	query, params, err := b.queryEventsSql(filter, true)
+	shape, query, params, err := b.queryEventsSql(filter, true, nil)
 	if err != nil {
 		return 0, err
 	}
 
+	stmt, err := b.stmtCache.getOrPrepare(b.DB, shape, query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare query %q: %w", query, err)
+	}
+
 	var count int64
-	if err = b.DB.QueryRow(query, params...).Scan(&count); err != nil && err != sql.ErrNoRows {
+	if err = stmt.QueryRowContext(ctx, params...).Scan(&count); err != nil && err != sql.ErrNoRows {
 		return 0, fmt.Errorf("failed to fetch events using query %q: %w", query, err)
 	}
 	return count, nil
 }
 
-func (b PostgresBackend) queryEventsSql(filter *nostr.Filter, doCount bool) (string, []any, error) {
+// queryEventsSql builds the SQL and parameters for a filter, and also
+// returns shape, a cache key describing which conditions are present and
+// how many placeholders (for tags, how many tag-name clauses) each group
+// contributes. Two filters that differ
+// only in parameter values (not in which groups are present or their
+// cardinalities) produce the same shape and hence the same SQL text, so the
+// statement built for one can be safely prepared once and reused for the
+// other (see stmtCache).
+func (b PostgresBackend) queryEventsSql(filter *nostr.Filter, doCount bool, cursor *pageCursor) (shape string, query string, params []any, err error) {
 	var conditions []string
-	var params []any
+	var idsN, authorsN, kindsN, tagsN int
+	var sinceSet, untilSet bool
 
 	if filter == nil {
-		return "", nil, fmt.Errorf("filter cannot be null")
+		return "", "", nil, fmt.Errorf("filter cannot be null")
 	}
 
 	if filter.IDs != nil {
 		if len(filter.IDs) > b.QueryIDsLimit {
 			// too many ids, fail everything
-			return "", nil, nil
+			return "", "", nil, nil
 		}
 
-		likeids := make([]string, 0, len(filter.IDs))
+		validIDs := make([]string, 0, len(filter.IDs))
 		for _, id := range filter.IDs {
 			// to prevent sql attack here we will check if
-			// these ids are valid 32byte hex
+			// these ids are valid 32byte hex; prefixes are not accepted,
+			// per NIP-01 filters match full ids only
 			parsed, err := hex.DecodeString(id)
 			if err != nil || len(parsed) != 32 {
 				continue
 			}
-			likeids = append(likeids, fmt.Sprintf("id LIKE '%x%%'", parsed))
+			validIDs = append(validIDs, id)
 		}
-		if len(likeids) == 0 {
+		if len(validIDs) == 0 {
 			// ids being [] mean you won't get anything
-			return "", nil, nil
+			return "", "", nil, nil
 		}
-		conditions = append(conditions, "("+strings.Join(likeids, " OR ")+")")
+		cond, args, err := sqlx.In("id IN (?)", validIDs)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("failed to build id filter: %w", err)
+		}
+		conditions = append(conditions, cond)
+		params = append(params, args...)
+		idsN = len(validIDs)
 	}
 
 	if filter.Authors != nil {
 		if len(filter.Authors) > b.QueryAuthorsLimit {
 			// too many authors, fail everything
-			return "", nil, nil
+			return "", "", nil, nil
 		}
 
-		likekeys := make([]string, 0, len(filter.Authors))
+		validAuthors := make([]string, 0, len(filter.Authors))
 		for _, key := range filter.Authors {
 			// to prevent sql attack here we will check if
-			// these keys are valid 32byte hex
+			// these keys are valid 32byte hex; prefixes are not accepted,
+			// per NIP-01 filters match full pubkeys only
 			parsed, err := hex.DecodeString(key)
 			if err != nil || len(parsed) != 32 {
 				continue
 			}
-			likekeys = append(likekeys, fmt.Sprintf("pubkey LIKE '%x%%'", parsed))
+			validAuthors = append(validAuthors, key)
 		}
-		if len(likekeys) == 0 {
+		if len(validAuthors) == 0 {
 			// authors being [] mean you won't get anything
-			return "", nil, nil
+			return "", "", nil, nil
+		}
+		cond, args, err := sqlx.In("pubkey IN (?)", validAuthors)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("failed to build author filter: %w", err)
 		}
-		conditions = append(conditions, "("+strings.Join(likekeys, " OR ")+")")
+		conditions = append(conditions, cond)
+		params = append(params, args...)
+		authorsN = len(validAuthors)
 	}
 
 	if filter.Kinds != nil {
 		if len(filter.Kinds) > b.QueryKindsLimit {
 			// too many kinds, fail everything
-			return "", nil, nil
+			return "", "", nil, nil
 		}
 
 		if len(filter.Kinds) == 0 {
 			// kinds being [] mean you won't get anything
-			return "", nil, nil
-		}
-		// no sql injection issues since these are ints
-		inkinds := make([]string, len(filter.Kinds))
-		for i, kind := range filter.Kinds {
-			inkinds[i] = strconv.Itoa(kind)
+			return "", "", nil, nil
 		}
-		conditions = append(conditions, `kind IN (`+strings.Join(inkinds, ",")+`)`)
+		// kind = ANY(?) keeps the placeholder count fixed at one regardless
+		// of how many kinds are requested, so the generated SQL (and its
+		// prepared statement) doesn't depend on the specific kind values
+		conditions = append(conditions, "kind = ANY(?)")
+		params = append(params, pq.Array(filter.Kinds))
+		kindsN = 1
 	}
 
-	tagQuery := make([]string, 0, 1)
-	for _, values := range filter.Tags {
+	tagCount := 0
+	for tagName, values := range filter.Tags {
 		if len(values) == 0 {
 			// any tag set to [] is wrong
-			return "", nil, nil
+			return "", "", nil, nil
 		}
 
-		// add these tags to the query
-		tagQuery = append(tagQuery, values...)
-
-		if len(tagQuery) > b.QueryTagsLimit {
+		tagCount += len(values)
+		if tagCount > b.QueryTagsLimit {
 			// too many tags, fail everything
-			return "", nil, nil
+			return "", "", nil, nil
 		}
-	}
 
-	if len(tagQuery) > 0 {
-		arrayBuild := make([]string, len(tagQuery))
-		for i, tagValue := range tagQuery {
-			arrayBuild[i] = "?"
-			params = append(params, tagValue)
-		}
-
-		// we use a very bad implementation in which we only check the tag values and
-		// ignore the tag names
+		// per NIP-01, conditions across different tag names are ANDed
+		// together, while the values for a single tag name are ORed
+		params = append(params, tagName, pq.Array(values))
 		conditions = append(conditions,
-			"tagvalues && ARRAY["+strings.Join(arrayBuild, ",")+"]")
+			"EXISTS (SELECT 1 FROM event_tag et WHERE et.event_id = event.id"+
+				" AND et.tag_name = ? AND et.tag_value = ANY(?))")
+		tagsN++
 	}
 
 	if filter.Since != nil {
 		conditions = append(conditions, "created_at >= ?")
 		params = append(params, filter.Since)
+		sinceSet = true
 	}
 	if filter.Until != nil {
 		conditions = append(conditions, "created_at <= ?")
 		params = append(params, filter.Until)
+		untilSet = true
+	}
+
+	if filter.Search != "" {
+		// the tsvector is computed per query rather than read from a
+		// generated column so that SearchLanguage can actually vary; a
+		// generated column's expression is fixed at creation time and
+		// can't be parameterized by a runtime dictionary choice
+		conditions = append(conditions, "to_tsvector(?, content) @@ plainto_tsquery(?, ?)")
+		params = append(params, b.SearchLanguage, b.SearchLanguage, filter.Search)
+	}
+
+	if cursor != nil {
+		// compares lexicographically on the (created_at, id) compound index
+		// so pages don't skip/repeat rows that share a created_at
+		conditions = append(conditions, "(created_at, id) < (?, ?)")
+		params = append(params, cursor.createdAt, cursor.id)
 	}
 
 	if len(conditions) == 0 {
@@ -174,26 +230,39 @@ func (b PostgresBackend) queryEventsSql(filter *nostr.Filter, doCount bool) (str
 		conditions = append(conditions, "true")
 	}
 
-	if filter.Limit < 1 || filter.Limit > b.QueryLimit {
-		params = append(params, b.QueryLimit)
+	shape = fmt.Sprintf("ids:%d|authors:%d|kinds:%d|tags:%d|since:%t|until:%t|search:%t|cursor:%t|limit:1|count:%t",
+		idsN, authorsN, kindsN, tagsN, sinceSet, untilSet, filter.Search != "", cursor != nil, doCount)
+
+	var selectClause string
+	if doCount {
+		selectClause = "SELECT COUNT(*) FROM event WHERE "
 	} else {
-		params = append(params, filter.Limit)
+		selectClause = `SELECT
+          id, pubkey, created_at, kind, tags, content, sig
+        FROM event WHERE `
 	}
 
-	var query string
+	query = selectClause + strings.Join(conditions, " AND ")
+
 	if doCount {
-		query = sqlx.Rebind(sqlx.BindType("postgres"), `SELECT
-          COUNT(*)
-        FROM event WHERE `+
-			strings.Join(conditions, " AND ")+
-			" ORDER BY created_at DESC LIMIT ?")
+		return shape, sqlx.Rebind(sqlx.BindType("postgres"), query), params, nil
+	}
+
+	// ranking by relevance requires re-evaluating the tsquery, so when a
+	// search is active it takes precedence over the default recency order
+	if filter.Search != "" {
+		query += " ORDER BY ts_rank_cd(to_tsvector(?, content), plainto_tsquery(?, ?)) DESC, created_at DESC"
+		params = append(params, b.SearchLanguage, b.SearchLanguage, filter.Search)
 	} else {
-		query = sqlx.Rebind(sqlx.BindType("postgres"), `SELECT
-          id, pubkey, created_at, kind, tags, content, sig
-        FROM event WHERE `+
-			strings.Join(conditions, " AND ")+
-			" ORDER BY created_at DESC LIMIT ?")
+		query += " ORDER BY created_at DESC, id DESC"
+	}
+
+	if filter.Limit < 1 || filter.Limit > b.QueryLimit {
+		params = append(params, b.QueryLimit)
+	} else {
+		params = append(params, filter.Limit)
 	}
+	query += " LIMIT ?"
 
-	return query, params, nil
+	return shape, sqlx.Rebind(sqlx.BindType("postgres"), query), params, nil
 }
@@ -0,0 +1,330 @@
+package postgresql
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	idA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	idB = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+func testBackend() PostgresBackend {
+	return PostgresBackend{
+		QueryLimit:        100,
+		QueryIDsLimit:     500,
+		QueryAuthorsLimit: 500,
+		QueryKindsLimit:   10,
+		QueryTagsLimit:    10,
+		SearchLanguage:    "simple",
+	}
+}
+
+func tsPtr(ts nostr.Timestamp) *nostr.Timestamp { return &ts }
+
+func TestQueryEventsSql(t *testing.T) {
+	b := testBackend()
+	bOneID := testBackend()
+	bOneID.QueryIDsLimit = 1
+
+	tests := []struct {
+		name       string
+		backend    PostgresBackend
+		filter     *nostr.Filter
+		doCount    bool
+		cursor     *pageCursor
+		wantEmpty  bool // query == "" && params == nil, not an error
+		wantErr    bool
+		wantInSQL  []string // substrings that must appear in the final SQL
+		wantNotInSQL []string // substrings that must not appear in the final SQL
+		wantParamN int      // expected len(params), 0 to skip the check
+		wantLimit  int      // expected LIMIT parameter (last param), 0 to skip the check
+	}{
+		{
+			name:       "empty filter falls back to true",
+			backend:    b,
+			filter:     &nostr.Filter{},
+			wantInSQL:  []string{"WHERE true", "ORDER BY created_at DESC", "LIMIT $1"},
+			wantParamN: 1,
+		},
+		{
+			name:       "single valid id",
+			backend:    b,
+			filter:     &nostr.Filter{IDs: []string{idA}},
+			wantInSQL:  []string{"id IN ($1)", "LIMIT $2"},
+			wantParamN: 2,
+		},
+		{
+			name:       "mixed valid and invalid hex ids keeps only the valid one",
+			backend:    b,
+			filter:     &nostr.Filter{IDs: []string{idA, "not-hex", "ab"}},
+			wantInSQL:  []string{"id IN ($1)"},
+			wantParamN: 2,
+		},
+		{
+			name:      "ids all invalid returns empty query",
+			backend:   b,
+			filter:    &nostr.Filter{IDs: []string{"not-hex"}},
+			wantEmpty: true,
+		},
+		{
+			name:      "too many ids returns empty query",
+			backend:   bOneID,
+			filter:    &nostr.Filter{IDs: []string{idA, idB}},
+			wantEmpty: true,
+		},
+		{
+			name:       "two ids expand to two placeholders",
+			backend:    b,
+			filter:     &nostr.Filter{IDs: []string{idA, idB}},
+			wantInSQL:  []string{"id IN ($1, $2)", "LIMIT $3"},
+			wantParamN: 3,
+		},
+		{
+			name:       "authors behave like ids",
+			backend:    b,
+			filter:     &nostr.Filter{Authors: []string{idA}},
+			wantInSQL:  []string{"pubkey IN ($1)"},
+			wantParamN: 2,
+		},
+		{
+			name:      "empty authors slice yields no rows",
+			backend:   b,
+			filter:    &nostr.Filter{Authors: []string{}},
+			wantEmpty: true,
+		},
+		{
+			name:       "kinds use a single array placeholder regardless of count",
+			backend:    b,
+			filter:     &nostr.Filter{Kinds: []int{1, 7}},
+			wantInSQL:  []string{"kind = ANY($1)", "LIMIT $2"},
+			wantParamN: 2,
+		},
+		{
+			name:      "empty kinds slice yields no rows",
+			backend:   b,
+			filter:    &nostr.Filter{Kinds: []int{}},
+			wantEmpty: true,
+		},
+		{
+			name:    "single tag filter",
+			backend: b,
+			filter:  &nostr.Filter{Tags: nostr.TagMap{"e": []string{idA}}},
+			wantInSQL: []string{
+				"EXISTS (SELECT 1 FROM event_tag et WHERE et.event_id = event.id AND et.tag_name = $1 AND et.tag_value = ANY($2))",
+			},
+			wantParamN: 3,
+		},
+		{
+			name:      "tag with no values is invalid",
+			backend:   b,
+			filter:    &nostr.Filter{Tags: nostr.TagMap{"e": []string{}}},
+			wantEmpty: true,
+		},
+		{
+			name:    "since and until",
+			backend: b,
+			filter: &nostr.Filter{
+				Since: tsPtr(100),
+				Until: tsPtr(200),
+			},
+			wantInSQL:  []string{"created_at >= $1", "created_at <= $2"},
+			wantParamN: 3,
+		},
+		{
+			name:    "since greater than until still builds a (never-matching) query",
+			backend: b,
+			filter: &nostr.Filter{
+				Since: tsPtr(200),
+				Until: tsPtr(100),
+			},
+			wantInSQL:  []string{"created_at >= $1", "created_at <= $2"},
+			wantParamN: 3,
+		},
+		{
+			name:    "search adds a tsvector condition and ranks by relevance",
+			backend: b,
+			filter:  &nostr.Filter{Search: "gm nostr"},
+			wantInSQL: []string{
+				"to_tsvector($1, content) @@ plainto_tsquery($2, $3)",
+				"ORDER BY ts_rank_cd(to_tsvector($4, content), plainto_tsquery($5, $6)) DESC, created_at DESC",
+			},
+			wantParamN: 7,
+		},
+		{
+			name:       "cursor adds a keyset condition",
+			backend:    b,
+			filter:     &nostr.Filter{},
+			cursor:     &pageCursor{createdAt: 500, id: idA},
+			wantInSQL:  []string{"(created_at, id) < ($1, $2)"},
+			wantParamN: 3,
+		},
+		{
+			name:      "doCount drops ORDER BY and LIMIT",
+			backend:   b,
+			filter:    &nostr.Filter{Kinds: []int{1}},
+			doCount:   true,
+			wantInSQL: []string{"SELECT COUNT(*) FROM event WHERE kind = ANY($1)"},
+			wantNotInSQL: []string{"ORDER BY", "LIMIT"},
+		},
+		{
+			name:    "nil filter errors",
+			backend: b,
+			filter:  nil,
+			wantErr: true,
+		},
+		{
+			name:    "limit above QueryLimit is clamped to QueryLimit",
+			backend: b,
+			filter: &nostr.Filter{
+				Kinds: []int{1},
+				Limit: 9999,
+			},
+			wantParamN: 2,
+			wantLimit:  100,
+		},
+		{
+			name:    "limit within range is kept as-is",
+			backend: b,
+			filter: &nostr.Filter{
+				Kinds: []int{1},
+				Limit: 5,
+			},
+			wantParamN: 2,
+			wantLimit:  5,
+		},
+		{
+			name:    "ids, kinds and tags combine with AND",
+			backend: b,
+			filter: &nostr.Filter{
+				IDs:   []string{idA},
+				Kinds: []int{1},
+				Tags:  nostr.TagMap{"p": []string{idB}},
+			},
+			wantInSQL: []string{
+				"id IN ($1)",
+				"kind = ANY($2)",
+				"et.tag_name = $3",
+				"et.tag_value = ANY($4)",
+				"id IN ($1) AND kind = ANY($2) AND EXISTS",
+			},
+			wantParamN: 5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, query, params, err := tt.backend.queryEventsSql(tt.filter, tt.doCount, tt.cursor)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tt.wantEmpty {
+				if query != "" || params != nil {
+					t.Fatalf("expected empty query/params, got query=%q params=%v", query, params)
+				}
+				return
+			}
+
+			for _, want := range tt.wantInSQL {
+				if !strings.Contains(query, want) {
+					t.Errorf("query %q does not contain %q", query, want)
+				}
+			}
+			for _, unwanted := range tt.wantNotInSQL {
+				if strings.Contains(query, unwanted) {
+					t.Errorf("query %q unexpectedly contains %q", query, unwanted)
+				}
+			}
+			if tt.wantParamN != 0 && len(params) != tt.wantParamN {
+				t.Errorf("len(params) = %d, want %d (params=%v)", len(params), tt.wantParamN, params)
+			}
+			if tt.wantLimit != 0 && (len(params) == 0 || params[len(params)-1] != tt.wantLimit) {
+				t.Errorf("limit param = %v, want %d (params=%v)", params, tt.wantLimit, params)
+			}
+		})
+	}
+}
+
+func TestQueryEventsDeliversRowsInOrder(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	b := testBackend()
+	b.DB = sqlx.NewDb(db, "postgres")
+	b.stmtCache = newStmtCache(10)
+
+	rows := sqlmock.NewRows([]string{"id", "pubkey", "created_at", "kind", "tags", "content", "sig"}).
+		AddRow(idA, idA, 100, 1, "[]", "first", "sig-a").
+		AddRow(idB, idB, 50, 1, "[]", "second", "sig-b")
+
+	mock.ExpectPrepare(".*").ExpectQuery().WillReturnRows(rows)
+
+	ch, err := b.QueryEvents(context.Background(), &nostr.Filter{Kinds: []int{1}})
+	if err != nil {
+		t.Fatalf("QueryEvents: %v", err)
+	}
+
+	var got []string
+	for evt := range ch {
+		got = append(got, evt.ID)
+	}
+
+	if len(got) != 2 || got[0] != idA || got[1] != idB {
+		t.Fatalf("events delivered out of order: %v", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unmet sqlmock expectations: %v", err)
+	}
+}
+
+func TestQueryEventsStopsOnContextCancel(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to open sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	b := testBackend()
+	b.DB = sqlx.NewDb(db, "postgres")
+	b.stmtCache = newStmtCache(10)
+
+	rows := sqlmock.NewRows([]string{"id", "pubkey", "created_at", "kind", "tags", "content", "sig"}).
+		AddRow(idA, idA, 100, 1, "[]", "first", "sig-a").
+		AddRow(idB, idB, 50, 1, "[]", "second", "sig-b")
+
+	mock.ExpectPrepare(".*").ExpectQuery().WillReturnRows(rows)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := b.QueryEvents(ctx, &nostr.Filter{Kinds: []int{1}})
+	if err != nil {
+		t.Fatalf("QueryEvents: %v", err)
+	}
+	cancel()
+
+	select {
+	case <-ch:
+		// either an event (if it raced ahead of cancellation) or a closed
+		// channel are both fine here; what must not happen is the
+		// goroutine hanging forever, which the timeout below catches.
+	case <-time.After(time.Second):
+		t.Fatal("QueryEvents did not stop after context cancellation")
+	}
+}
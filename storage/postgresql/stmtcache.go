@@ -0,0 +1,82 @@
+package postgresql
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// stmtCache is an LRU cache of prepared statements keyed by the structural
+// shape of a filter (see queryEventsSql), so that repeated REQ messages with the
+// same shape but different parameter values reuse an already-parsed plan
+// instead of paying SQL parsing/planning on every call.
+type stmtCache struct {
+	mu      sync.Mutex
+	maxSize int
+	entries map[string]*list.Element
+	order   *list.List // front = most recently used
+}
+
+type stmtCacheEntry struct {
+	key  string
+	stmt *sqlx.Stmt
+}
+
+func newStmtCache(maxSize int) *stmtCache {
+	return &stmtCache{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// getOrPrepare returns a statement prepared against db for the given shape
+// key and query, preparing and caching it lazily on a miss. On eviction the
+// displaced statement is closed.
+func (c *stmtCache) getOrPrepare(db *sqlx.DB, key, query string) (*sqlx.Stmt, error) {
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		stmt := elem.Value.(*stmtCacheEntry).stmt
+		c.mu.Unlock()
+		return stmt, nil
+	}
+	c.mu.Unlock()
+
+	stmt, err := db.Preparex(query)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// another goroutine may have prepared the same shape while we were
+	// outside the lock; keep theirs and close ours to avoid leaking a
+	// duplicate server-side prepared statement
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		cached := elem.Value.(*stmtCacheEntry).stmt
+		stmt.Close()
+		return cached, nil
+	}
+
+	elem := c.order.PushFront(&stmtCacheEntry{key: key, stmt: stmt})
+	c.entries[key] = elem
+
+	if c.maxSize > 0 {
+		for c.order.Len() > c.maxSize {
+			oldest := c.order.Back()
+			if oldest == nil {
+				break
+			}
+			c.order.Remove(oldest)
+			evicted := oldest.Value.(*stmtCacheEntry)
+			delete(c.entries, evicted.key)
+			evicted.stmt.Close()
+		}
+	}
+
+	return stmt, nil
+}
@@ -0,0 +1,88 @@
+package postgresql
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const benchAuthor = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+
+// benchFilter is a representative REQ filter repeated on every iteration,
+// simulating a busy relay re-issuing the same shape of subscription query.
+func benchFilter() *nostr.Filter {
+	return &nostr.Filter{
+		Authors: []string{benchAuthor},
+		Kinds:   []int{1},
+		Limit:   50,
+	}
+}
+
+func newMockBackend(tb testing.TB) (PostgresBackend, sqlmock.Sqlmock) {
+	tb.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		tb.Fatalf("failed to open sqlmock: %v", err)
+	}
+
+	b := PostgresBackend{
+		DB:             sqlx.NewDb(db, "postgres"),
+		QueryLimit:        100,
+		QueryIDsLimit:     500,
+		QueryAuthorsLimit: 500,
+		QueryKindsLimit:   10,
+		QueryTagsLimit:    10,
+		SearchLanguage:    "simple",
+	}
+	return b, mock
+}
+
+func BenchmarkQueryEvents_AdHoc(b *testing.B) {
+	backend, mock := newMockBackend(b)
+	defer backend.DB.Close()
+
+	filter := benchFilter()
+	rows := sqlmock.NewRows([]string{"id", "pubkey", "created_at", "kind", "tags", "content", "sig"})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mock.ExpectQuery(".*").WillReturnRows(rows)
+		_, query, params, err := backend.queryEventsSql(filter, false, nil)
+		if err != nil {
+			b.Fatalf("queryEventsSql: %v", err)
+		}
+		if _, err := backend.DB.QueryContext(context.Background(), query, params...); err != nil {
+			b.Fatalf("query: %v", err)
+		}
+	}
+}
+
+func BenchmarkQueryEvents_Cached(b *testing.B) {
+	backend, mock := newMockBackend(b)
+	defer backend.DB.Close()
+	backend.stmtCache = newStmtCache(200)
+
+	filter := benchFilter()
+	rows := sqlmock.NewRows([]string{"id", "pubkey", "created_at", "kind", "tags", "content", "sig"})
+	mock.ExpectPrepare(".*")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mock.ExpectQuery(".*").WillReturnRows(rows)
+		shape, query, params, err := backend.queryEventsSql(filter, false, nil)
+		if err != nil {
+			b.Fatalf("queryEventsSql: %v", err)
+		}
+		stmt, err := backend.stmtCache.getOrPrepare(backend.DB, shape, query)
+		if err != nil {
+			b.Fatalf("getOrPrepare: %v", err)
+		}
+		if _, err := stmt.QueryContext(context.Background(), params...); err != nil {
+			b.Fatalf("query: %v", err)
+		}
+	}
+}